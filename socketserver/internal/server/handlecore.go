@@ -1,6 +1,7 @@
 package server // import "bitbucket.org/stendec/frankerfacez/socketserver/internal/server"
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -30,11 +32,30 @@ const HelloCommand Command = "hello"
 // AuthorizeCommand is a S2C Command sent as part of Twitch username validation.
 const AuthorizeCommand Command = "do_authorize"
 
+// ResumeCommand is a C2S Command.
+// Like HelloCommand, ResumeCommand is only valid as the first message sent
+// during a connection; it re-attaches to a ClientInfo from a prior
+// connection instead of starting a fresh one. See TryResumeSession.
+const ResumeCommand Command = "resume"
+
+// PresenceJoinCommand is an S2C push sent to a channel's subscribers when a
+// client joins it.
+const PresenceJoinCommand Command = "presence_join"
+
+// PresenceLeaveCommand is an S2C push sent to a channel's subscribers when a
+// client leaves it.
+const PresenceLeaveCommand Command = "presence_leave"
+
 // AsyncResponseCommand is a pseudo-Reply Command.
 // It indicates that the Reply Command to the client's C2S Command will be delivered
 // on a goroutine over the ClientInfo.MessageChannel and should not be delivered immediately.
 const AsyncResponseCommand Command = "_async"
 
+// ResumeTokenCommand is an S2C push sent right after a successful hello or resume,
+// carrying the resume token (see IssueResumeToken) the client should hang
+// onto and present via ResumeCommand if this connection drops.
+const ResumeTokenCommand Command = "_resume_token"
+
 // ResponseSuccess is a Reply ClientMessage with the MessageID not yet filled out.
 var ResponseSuccess = ClientMessage{Command: SuccessCommand}
 
@@ -63,6 +84,7 @@ func SetupServerAndHandle(config *ConfigFile, serveMux *http.ServeMux) {
 	serveMux.HandleFunc("/drop_backlog", HBackendDropBacklog)
 	serveMux.HandleFunc("/uncached_pub", HBackendPublishRequest)
 	serveMux.HandleFunc("/cached_pub", HBackendUpdateAndPublish)
+	serveMux.HandleFunc("/presence", HBackendPresence)
 
 	announceForm, err := SealRequest(url.Values{
 		"startup": []string{"1"},
@@ -90,23 +112,60 @@ func SetupServerAndHandle(config *ConfigFile, serveMux *http.ServeMux) {
 var SocketUpgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return r.Header.Get("Origin") == "http://www.twitch.tv"
-	},
+	CheckOrigin:     checkOrigin,
+	// Negotiate permessage-deflate so the compressed frame for a prepared
+	// broadcast message (see OutgoingMessage) is also computed exactly once.
+	EnableCompression: true,
+}
+
+// checkOrigin allows an Origin against Configuration.AllowedOrigins, which
+// may contain exact origins (`http://www.twitch.tv`) or `*.twitch.tv`-style
+// wildcard hosts. Falls back to the historical single-origin check if the
+// configuration doesn't set an allowlist, so existing deploys keep working.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	allowed := Configuration.AllowedOrigins
+	if len(allowed) == 0 {
+		return origin == "http://www.twitch.tv"
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range allowed {
+		if pattern == origin {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(originURL.Host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
 }
 
 // BannerHTML is the content served to web browsers viewing the socket server website.
 // Memes go here.
 var BannerHTML []byte
 
+// ServeWebsocketOrCatbag handles a classic HTTP/1.1 Upgrade request for the
+// websocket. It does not speak RFC 8441 (WebSockets over HTTP/2 via extended
+// CONNECT) - an h2c front-end terminating HTTP/2 to us would need to
+// downgrade to HTTP/1.1 Upgrade semantics itself, since net/http's
+// server-side http2 support doesn't expose extended CONNECT to handlers.
 func ServeWebsocketOrCatbag(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("Connection") == "Upgrade" {
+	// A lowercase substring match (rather than an exact comparison) so a
+	// reverse proxy that appends tokens to the Connection header (e.g.
+	// "keep-alive, Upgrade") still gets recognized.
+	if strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
 		conn, err := SocketUpgrader.Upgrade(w, r, nil)
 		if err != nil {
 			fmt.Fprintf(w, "error: %v", err)
 			return
 		}
-		HandleSocketConnection(conn)
+		HandleSocketConnection(conn, remoteAddrFromRequest(r, conn))
 
 		return
 	} else {
@@ -114,6 +173,65 @@ func ServeWebsocketOrCatbag(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// remoteAddrFromRequest resolves the real client address for a just-upgraded
+// connection. If the TCP peer is a configured trusted proxy, the address is
+// taken from the X-Forwarded-For/Forwarded headers instead of conn.RemoteAddr()
+// so rate-limit and ban logic see the real client rather than the proxy.
+//
+// We only trust a single reverse-proxy hop, so we take the *last* entry in
+// either header - the one the trusted proxy itself appended - rather than
+// the first, which is client-supplied and trivially spoofable.
+func remoteAddrFromRequest(r *http.Request, conn *websocket.Conn) net.Addr {
+	peerAddr := conn.RemoteAddr()
+
+	if !isTrustedProxy(peerAddr) {
+		return peerAddr
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		if addr := strings.TrimSpace(parts[len(parts)-1]); addr != "" {
+			return ipAddr(addr)
+		}
+	}
+
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		for _, part := range strings.Split(hops[len(hops)-1], ";") {
+			part = strings.TrimSpace(part)
+			eqIdx := strings.IndexRune(part, '=')
+			if eqIdx == -1 {
+				continue
+			}
+			if key := part[:eqIdx]; strings.EqualFold(key, "for") {
+				return ipAddr(strings.Trim(part[eqIdx+1:], `"`))
+			}
+		}
+	}
+
+	return peerAddr
+}
+
+func isTrustedProxy(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	for _, proxy := range Configuration.TrustedProxies {
+		if proxy == host {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAddr implements net.Addr for an address recovered from a proxy header,
+// where we only have a string, not an actual socket.
+type ipAddr string
+
+func (a ipAddr) Network() string { return "tcp" }
+func (a ipAddr) String() string  { return string(a) }
+
 // Errors that get returned to the client.
 var ProtocolError error = errors.New("FFZ Socket protocol error.")
 var ProtocolErrorNegativeID error = errors.New("FFZ Socket protocol error: negative or zero message ID.")
@@ -130,13 +248,43 @@ var CloseFirstMessageNotHello = websocket.CloseError{
 	Text: "Error - the first message sent must be a 'hello'",
 	Code: websocket.ClosePolicyViolation,
 }
+var CloseQueueFull = websocket.CloseError{
+	Text: "subscriber buffer full",
+	Code: websocket.ClosePolicyViolation,
+}
+
+// ConnectionClosedError is returned by ClientInfo.Call when the connection
+// it was waiting on is torn down before the client replies.
+var ConnectionClosedError error = errors.New("FFZ Socket: connection closed before server-initiated call completed.")
+
+// clientHolder is a mutex-guarded *ClientInfo. HandleSocketConnection's
+// RunLoop reassigns its local `client` variable on a successful resume; the
+// reader goroutine it launches needs to see that repointing too, and a bare
+// closure over a reassignable local would race the RunLoop goroutine's
+// write. Both sides go through get()/set() instead.
+type clientHolder struct {
+	mu sync.RWMutex
+	c  *ClientInfo
+}
+
+func (h *clientHolder) get() *ClientInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.c
+}
+
+func (h *clientHolder) set(c *ClientInfo) {
+	h.mu.Lock()
+	h.c = c
+	h.mu.Unlock()
+}
 
 // Handle a new websocket connection from a FFZ client.
 // This runs in a goroutine started by net/http.
-func HandleSocketConnection(conn *websocket.Conn) {
+func HandleSocketConnection(conn *websocket.Conn, remoteAddr net.Addr) {
 	// websocket.Conn is a ReadWriteCloser
 
-	log.Println("Got socket connection from", conn.RemoteAddr())
+	log.Println("Got socket connection from", remoteAddr)
 
 	var _closer sync.Once
 	closer := func() {
@@ -149,17 +297,30 @@ func HandleSocketConnection(conn *websocket.Conn) {
 	defer closer()
 
 	_clientChan := make(chan ClientMessage)
-	_serverMessageChan := make(chan ClientMessage)
+	// Bounded so a slow client can never force a publisher to block while
+	// holding ChatSubscriptionLock or a SubscriberList.RLock - see trySend.
+	_serverMessageChan := make(chan OutgoingMessage, ClientSendQueueSize)
+	_overflowChan := make(chan struct{}, 1)
 	_errorChan := make(chan error)
 	stoppedChan := make(chan struct{})
 
-	var client ClientInfo
+	// client is a pointer so a successful `resume` can repoint it at the
+	// *ClientInfo from a prior connection instead of this fresh one.
+	client := &ClientInfo{}
 	client.MessageChannel = _serverMessageChan
-	client.RemoteAddr = conn.RemoteAddr()
+	client.QueueOverflow = _overflowChan
+	client.RemoteAddr = remoteAddr
 	client.MsgChannelIsDone = stoppedChan
 
+	// holder mirrors `client` for the reader goroutine below: RunLoop
+	// reassigns the local `client` variable on a successful resume, and a
+	// bare closure over it would let the reader goroutine race that
+	// reassignment (see clientHolder).
+	holder := &clientHolder{}
+	holder.set(client)
+
 	// Launch receiver goroutine
-	go func(errorChan chan<- error, clientChan chan<- ClientMessage, stoppedChan <-chan struct{}) {
+	go func(errorChan chan<- error, clientChan chan<- ClientMessage, stoppedChan <-chan struct{}, holder *clientHolder) {
 		var msg ClientMessage
 		var messageType int
 		var packet []byte
@@ -178,6 +339,11 @@ func HandleSocketConnection(conn *websocket.Conn) {
 			if msg.MessageID == 0 {
 				continue
 			}
+			if msg.MessageID < -1 {
+				// Reply to a server-initiated Call, not a C2S command.
+				holder.get().deliverReply(msg)
+				continue
+			}
 			select {
 			case clientChan <- msg:
 			case <-stoppedChan:
@@ -198,16 +364,17 @@ func HandleSocketConnection(conn *websocket.Conn) {
 		close(errorChan)
 		close(clientChan)
 		// exit
-	}(_errorChan, _clientChan, stoppedChan)
+	}(_errorChan, _clientChan, stoppedChan, holder)
 
 	conn.SetPongHandler(func(pongBody string) error {
-		client.pingCount = 0
+		holder.get().pingCount = 0
 		return nil
 	})
 
 	var errorChan <-chan error = _errorChan
 	var clientChan <-chan ClientMessage = _clientChan
-	var serverMessageChan <-chan ClientMessage = _serverMessageChan
+	var serverMessageChan <-chan OutgoingMessage = _serverMessageChan
+	var overflowChan <-chan struct{} = _overflowChan
 
 	// All set up, now enter the work loop
 
@@ -230,17 +397,49 @@ RunLoop:
 			break RunLoop
 
 		case msg := <-clientChan:
+			if client.Version == "" && msg.Command == ResumeCommand {
+				var resumed *ClientInfo
+				if token, err := msg.ArgumentsAsString(); err == nil {
+					resumed = TryResumeSession(token, client)
+				}
+				if resumed != nil {
+					client = resumed
+					holder.set(resumed)
+					SendMessage(conn, OutgoingMessage{Msg: ResponseSuccess})
+					// Reissue a token so a later blip can be survived too -
+					// otherwise only the very first disconnect ever gets a
+					// resume window.
+					newToken := IssueResumeToken(client)
+					SendMessage(conn, OutgoingMessage{Msg: ClientMessage{Command: ResumeTokenCommand, Arguments: newToken}})
+					continue
+				}
+				log.Println("error - resume token rejected from", remoteAddr)
+				CloseConnection(conn, &CloseFirstMessageNotHello)
+				break RunLoop
+			}
+
 			if client.Version == "" && msg.Command != HelloCommand {
-				log.Println("error - first message wasn't hello from", conn.RemoteAddr(), "-", msg)
+				log.Println("error - first message wasn't hello from", remoteAddr, "-", msg)
 				CloseConnection(conn, &CloseFirstMessageNotHello)
 				break RunLoop
 			}
 
-			HandleCommand(conn, &client, msg)
+			wasHello := msg.Command == HelloCommand && client.Version == ""
+
+			HandleCommand(conn, client, msg)
+
+			if wasHello && client.Version != "" {
+				token := IssueResumeToken(client)
+				SendMessage(conn, OutgoingMessage{Msg: ClientMessage{Command: ResumeTokenCommand, Arguments: token}})
+			}
 
 		case smsg := <-serverMessageChan:
 			SendMessage(conn, smsg)
 
+		case <-overflowChan:
+			CloseConnection(conn, &CloseQueueFull)
+			break RunLoop
+
 		case <-time.After(1 * time.Minute):
 			client.pingCount++
 			if client.pingCount == 5 {
@@ -254,16 +453,42 @@ RunLoop:
 
 	// Exit
 
+	close(stoppedChan)
+
+	// If the client has an outstanding resume token, give it ResumeTTL to
+	// reattach over a new connection before tearing down its subscriptions -
+	// this is what lets a brief network blip survive without Twitch-side
+	// churn. The token only becomes redeemable here, now that the
+	// connection has actually disconnected (see beginResumeWindow).
+	// _serverMessageChan is deliberately left undrained/unclosed in that
+	// case: TryResumeSession flushes it onto the new connection, or (if the
+	// token is never redeemed) finishTeardown cleans it up once ResumeTTL
+	// elapses. Otherwise, same as always: tear down right away.
+	client.Mutex.Lock()
+	token := client.ResumeToken
+	client.Mutex.Unlock()
+
+	if token != "" {
+		beginResumeWindow(token, client, func() {
+			finishTeardown(client, _serverMessageChan)
+		})
+	} else {
+		finishTeardown(client, _serverMessageChan)
+	}
+
+	log.Println("End socket connection from", remoteAddr)
+}
+
+// finishTeardown drains and closes serverMessageChan (so any publisher
+// still mid-send doesn't block) and unsubscribes client from everything.
+func finishTeardown(client *ClientInfo, serverMessageChan chan OutgoingMessage) {
 	// Launch message draining goroutine - we aren't out of the pub/sub records
 	go func() {
-		for _ = range _serverMessageChan {
+		for _ = range serverMessageChan {
 		}
 	}()
 
-	close(stoppedChan)
-
-	// Stop getting messages...
-	UnsubscribeAll(&client)
+	UnsubscribeAll(client)
 
 	// Wait for pending jobs to finish...
 	client.MsgChannelKeepalive.Wait()
@@ -271,9 +496,7 @@ RunLoop:
 
 	// And done.
 	// Close the channel so the draining goroutine can finish, too.
-	close(_serverMessageChan)
-
-	log.Println("End socket connection from", conn.RemoteAddr())
+	close(serverMessageChan)
 }
 
 func getDeadline() time.Time {
@@ -294,6 +517,68 @@ func CallHandler(handler CommandHandler, conn *websocket.Conn, client *ClientInf
 	return handler(conn, client, cmsg)
 }
 
+// Call sends a server-initiated RPC to the client and blocks until the
+// client replies with a matching MessageID, ctx is cancelled, or the
+// connection is torn down. MessageIDs less than -1 are reserved for this:
+// the server picks one, the client must echo it back with ok/error.
+func (client *ClientInfo) Call(ctx context.Context, command Command, args interface{}) (ClientMessage, error) {
+	replyChan := make(chan ClientMessage, 1)
+
+	client.Mutex.Lock()
+	client.nextServerMessageID--
+	if client.nextServerMessageID == -1 {
+		client.nextServerMessageID = -2
+	}
+	id := client.nextServerMessageID
+	if client.pendingCalls == nil {
+		client.pendingCalls = make(map[int]chan ClientMessage)
+	}
+	client.pendingCalls[id] = replyChan
+	msgChan := client.MessageChannel
+	done := client.MsgChannelIsDone
+	client.Mutex.Unlock()
+
+	defer func() {
+		client.Mutex.Lock()
+		delete(client.pendingCalls, id)
+		client.Mutex.Unlock()
+	}()
+
+	select {
+	case msgChan <- OutgoingMessage{Msg: ClientMessage{MessageID: id, Command: command, Arguments: args}}:
+	case <-ctx.Done():
+		return ClientMessage{}, ctx.Err()
+	case <-done:
+		return ClientMessage{}, ConnectionClosedError
+	}
+
+	select {
+	case reply := <-replyChan:
+		if reply.Command == ErrorCommand {
+			return reply, fmt.Errorf("client returned error for %s call: %v", command, reply.Arguments)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return ClientMessage{}, ctx.Err()
+	case <-done:
+		return ClientMessage{}, ConnectionClosedError
+	}
+}
+
+// deliverReply routes a client's reply to a server-initiated Call back to
+// the goroutine waiting on it in Call, if there still is one.
+func (client *ClientInfo) deliverReply(msg ClientMessage) {
+	client.Mutex.Lock()
+	replyChan, ok := client.pendingCalls[msg.MessageID]
+	client.Mutex.Unlock()
+	if ok {
+		select {
+		case replyChan <- msg:
+		default:
+		}
+	}
+}
+
 func CloseConnection(conn *websocket.Conn, closeMsg *websocket.CloseError) {
 	if closeMsg != &CloseFirstMessageNotHello {
 		log.Println("Terminating connection with", conn.RemoteAddr(), "-", closeMsg.Text)
@@ -302,14 +587,42 @@ func CloseConnection(conn *websocket.Conn, closeMsg *websocket.CloseError) {
 	conn.Close()
 }
 
-// SendMessage sends a ClientMessage over the websocket connection with a timeout.
-// If marshalling the ClientMessage fails, this function will panic.
-func SendMessage(conn *websocket.Conn, msg ClientMessage) {
-	messageType, packet, err := MarshalClientMessage(msg)
+// OutgoingMessage is what travels over a ClientInfo.MessageChannel. Exactly
+// one of Msg or Prepared is meaningful: Prepared carries an already
+// marshalled (and possibly permessage-deflate compressed) frame so a
+// broadcast to many subscribers only pays that cost once, via
+// PrepareClientMessage/PublishToAll/PublishToMultiple.
+type OutgoingMessage struct {
+	Msg      ClientMessage
+	Prepared *websocket.PreparedMessage
+}
+
+// PrepareClientMessage marshals msg once into an immutable *websocket.PreparedMessage.
+// Sending the same PreparedMessage to N connections costs one marshal (and
+// one compression pass) instead of N.
+func PrepareClientMessage(msg ClientMessage) (*websocket.PreparedMessage, error) {
+	messageType, data, err := MarshalClientMessage(msg)
 	if err != nil {
-		panic(fmt.Sprintf("failed to marshal: %v %v", err, msg))
+		return nil, err
 	}
+	return websocket.NewPreparedMessage(messageType, data)
+}
+
+// SendMessage sends an OutgoingMessage over the websocket connection with a
+// timeout. If marshalling a non-prepared ClientMessage fails, this function
+// will panic.
+func SendMessage(conn *websocket.Conn, msg OutgoingMessage) {
 	conn.SetWriteDeadline(getDeadline())
+
+	if msg.Prepared != nil {
+		conn.WritePreparedMessage(msg.Prepared)
+		return
+	}
+
+	messageType, packet, err := MarshalClientMessage(msg.Msg)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal: %v %v", err, msg.Msg))
+	}
 	conn.WriteMessage(messageType, packet)
 }
 
@@ -326,7 +639,10 @@ func UnmarshalClientMessage(data []byte, payloadType int, v interface{}) (err er
 		return ProtocolError
 	}
 	messageID, err := strconv.Atoi(dataStr[:spaceIdx])
-	if messageID < -1 || messageID == 0 {
+	// MessageID 0 is invalid; -1 is a server push with no reply; anything
+	// less than -1 is either a server-initiated Call or a client's reply
+	// to one (see ClientInfo.Call).
+	if messageID == 0 {
 		return ProtocolErrorNegativeID
 	}
 
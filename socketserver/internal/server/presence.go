@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// presenceMember is one entry in a presence roster: a stable per-ClientInfo
+// ID (see anonymizedID) so two distinct viewers - including two different anonymous ones - can
+// be told apart, plus the display identity presenceIdentity already gives
+// them.
+type presenceMember struct {
+	ID       string `json:"id"`
+	Identity string `json:"identity"`
+}
+
+// presenceResponse is the payload shared by the `presence` C2S command and
+// the /presence backend endpoint.
+type presenceResponse struct {
+	Total         int              `json:"total"`
+	Authenticated int              `json:"authenticated"`
+	Anonymous     int              `json:"anonymous"`
+	Members       []presenceMember `json:"members"`
+}
+
+func buildPresenceResponse(channelName string) presenceResponse {
+	total, authenticated, anonymous := PresenceStats(channelName)
+	members := PresenceMembers(channelName)
+
+	entries := make([]presenceMember, len(members))
+	for i, m := range members {
+		entries[i] = presenceMember{
+			ID:       anonymizedID(m),
+			Identity: presenceIdentity(m),
+		}
+	}
+
+	return presenceResponse{
+		Total:         total,
+		Authenticated: authenticated,
+		Anonymous:     anonymous,
+		Members:       entries,
+	}
+}
+
+// anonymizedID gives each ClientInfo a stable identifier for as long as the
+// process keeps it alive, without exposing anything about who's behind it -
+// enough to tell two concurrent anonymous viewers apart in a roster, which
+// presenceIdentity's shared "anonymous" label can't.
+func anonymizedID(client *ClientInfo) string {
+	return fmt.Sprintf("%p", client)
+}
+
+// HandlePresenceCommand answers the `presence` C2S command with the roster
+// of clients subscribed to a channel, so the FFZ extension can show "N
+// viewers using FFZ" without hitting the backend.
+func HandlePresenceCommand(conn *websocket.Conn, client *ClientInfo, cmsg ClientMessage) (ClientMessage, error) {
+	channelName, err := cmsg.ArgumentsAsString()
+	if err != nil {
+		return ClientMessage{}, err
+	}
+
+	argBytes, err := json.Marshal(buildPresenceResponse(channelName))
+	if err != nil {
+		return ClientMessage{}, err
+	}
+
+	return SuccessMessageFromString(string(argBytes)), nil
+}
+
+// HBackendPresence serves GET /presence?channel=name with the same roster
+// data as the `presence` C2S command, for backend services.
+func HBackendPresence(w http.ResponseWriter, r *http.Request) {
+	channelName := r.URL.Query().Get("channel")
+	if channelName == "" {
+		http.Error(w, "missing channel parameter", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildPresenceResponse(channelName))
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ResumeTTL is how long a disconnected client's subscriptions are kept
+// alive, waiting for a `resume <token>` on a new connection, before they're
+// torn down for good.
+const ResumeTTL = 60 * time.Second
+
+type resumeEntry struct {
+	Client *ClientInfo
+	timer  *time.Timer
+}
+
+var resumeTokensLock sync.Mutex
+var resumeTokens = make(map[string]*resumeEntry)
+
+// IssueResumeToken allocates an opaque resume token and records it on client
+// so a later `resume <token>` knows which session to ask for.
+// HandleSocketConnection calls it after a successful hello and after a
+// successful resume, and sends the token to the client in a separate
+// ResumeTokenCommand push; the `ok` reply itself does not carry it.
+//
+// The token isn't redeemable yet: `resume <token>` only works once
+// beginResumeWindow has registered it from the teardown path, i.e. after
+// this connection has actually disconnected. Until then the client holding
+// a live connection can't be raced by someone else replaying its token.
+func IssueResumeToken(client *ClientInfo) string {
+	token := randomResumeToken()
+
+	client.Mutex.Lock()
+	client.ResumeToken = token
+	client.Mutex.Unlock()
+
+	return token
+}
+
+func randomResumeToken() string {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(raw[:])
+}
+
+// beginResumeWindow makes token redeemable via `resume <token>` for
+// ResumeTTL, running onExpire if it goes unredeemed that long. Called once
+// the connection that held token has actually disconnected - this is the
+// only place a token becomes valid input to TryResumeSession.
+func beginResumeWindow(token string, client *ClientInfo, onExpire func()) {
+	resumeTokensLock.Lock()
+	entry := &resumeEntry{Client: client}
+	entry.timer = time.AfterFunc(ResumeTTL, func() {
+		resumeTokensLock.Lock()
+		delete(resumeTokens, token)
+		resumeTokensLock.Unlock()
+		onExpire()
+	})
+	resumeTokens[token] = entry
+	resumeTokensLock.Unlock()
+}
+
+// TryResumeSession looks up token and, if it names a client whose resume
+// window is currently open (see beginResumeWindow), re-attaches it to a
+// freshly upgraded connection: the old ClientInfo's subscription state
+// (CurrentChannels, WatchingChannels, authentication) is preserved as-is,
+// its MessageChannel/QueueOverflow/RemoteAddr are repointed at fresh's
+// connection, and anything that queued up on the old channel while it was
+// disconnected is flushed onto the new one. Returns nil if the token is
+// unknown, already expired, or still belongs to a connection that hasn't
+// disconnected yet.
+func TryResumeSession(token string, fresh *ClientInfo) *ClientInfo {
+	resumeTokensLock.Lock()
+	entry, ok := resumeTokens[token]
+	if ok {
+		delete(resumeTokens, token)
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+	resumeTokensLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	old := entry.Client
+
+	old.Mutex.Lock()
+	oldChan := old.MessageChannel
+	old.MessageChannel = fresh.MessageChannel
+	old.QueueOverflow = fresh.QueueOverflow
+	old.RemoteAddr = fresh.RemoteAddr
+	old.MsgChannelIsDone = fresh.MsgChannelIsDone
+	old.ResumeToken = ""
+	old.Mutex.Unlock()
+
+	// Flush anything that was enqueued on the old connection's channel
+	// while the client was disconnected; it would otherwise sit there
+	// forever since nothing is draining it anymore.
+drain:
+	for {
+		select {
+		case msg, open := <-oldChan:
+			if !open {
+				break drain
+			}
+			select {
+			case old.MessageChannel <- msg:
+			default:
+			}
+		default:
+			break drain
+		}
+	}
+
+	return old
+}
@@ -7,21 +7,119 @@ import (
 	"log"
 	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+// ClientSendQueueSize bounds how many outstanding messages a subscriber's
+// MessageChannel may hold. A client that can't keep up with the fanout
+// rate gets disconnected instead of stalling every publisher behind it.
+const ClientSendQueueSize = 256
+
+// subscriber refers to the subscribed ClientInfo rather than snapshotting
+// its MessageChannel/QueueOverflow, so that a successful session resume -
+// which repoints those fields at a new connection - is visible to every
+// publisher without walking every SubscriberList the client is a member of.
+type subscriber struct {
+	Client *ClientInfo
+}
+
+// ChannelHistorySize is how many recent messages are kept per channel so a
+// reconnecting client can catch up instead of missing traffic outright.
+const ChannelHistorySize = 50
+
+// cachedMessage is one entry in a SubscriberList's replay history.
+type cachedMessage struct {
+	Seq uint64
+	Msg ClientMessage
+}
+
 type SubscriberList struct {
 	sync.RWMutex
-	Members []chan<- ClientMessage
+	Members []*subscriber
+
+	historyLock sync.Mutex
+	history     []cachedMessage
+	seq         uint64
 }
 
 var ChatSubscriptionInfo map[string]*SubscriberList = make(map[string]*SubscriberList)
 var ChatSubscriptionLock sync.RWMutex
 var GlobalSubscriptionInfo SubscriberList
 
-func SubscribeChannel(client *ClientInfo, channelName string) {
+// SubscribeChannel subscribes the client to channelName. If lastSeq is
+// nonzero, any buffered messages with a higher sequence are then replayed
+// over client.MessageChannel. The client is added to the live subscriber
+// list before the replay is enqueued, so live messages published in between
+// can arrive ahead of replayed ones, and a message can arrive both live and
+// in the replay.
+func SubscribeChannel(client *ClientInfo, channelName string, lastSeq uint64) {
 	ChatSubscriptionLock.RLock()
-	_subscribeWhileRlocked(channelName, client.MessageChannel)
+	list := _subscribeWhileRlocked(channelName, client)
 	ChatSubscriptionLock.RUnlock()
+
+	if lastSeq == 0 {
+		return
+	}
+
+	list.historyLock.Lock()
+	replay := make([]cachedMessage, 0, len(list.history))
+	for _, entry := range list.history {
+		if entry.Seq > lastSeq {
+			replay = append(replay, entry)
+		}
+	}
+	list.historyLock.Unlock()
+
+	self := &subscriber{Client: client}
+	for _, entry := range replay {
+		// Goes through trySend, not a bare send on client.MessageChannel, so
+		// a resume racing this replay can't read a torn/stale channel
+		// reference (see trySend).
+		trySend(self, OutgoingMessage{Msg: entry.Msg})
+	}
+}
+
+// HandleSubscribeCommand is the CommandHandler for the `sub` C2S command.
+// Arguments are either a bare channel name, for a plain subscribe, or
+// [channel, last_seq] so a reconnecting client also gets the buffered
+// history it missed (see recordAndStamp and SubscribeChannel).
+func HandleSubscribeCommand(conn *websocket.Conn, client *ClientInfo, cmsg ClientMessage) (ClientMessage, error) {
+	channelName, lastSeq, err := parseSubscribeArguments(cmsg)
+	if err != nil {
+		return ClientMessage{}, err
+	}
+
+	SubscribeChannel(client, channelName, lastSeq)
+	return ResponseSuccess, nil
+}
+
+// parseSubscribeArguments reads the `sub` command's arguments, accepting
+// either a bare channel name or [channel, last_seq].
+func parseSubscribeArguments(cmsg ClientMessage) (channelName string, lastSeq uint64, err error) {
+	if channelName, err = cmsg.ArgumentsAsString(); err == nil {
+		return channelName, 0, nil
+	}
+
+	channelName, seq, err := cmsg.ArgumentsAsStringAndInt()
+	if err != nil || seq < 0 {
+		return "", 0, ExpectedStringAndInt
+	}
+	return channelName, uint64(seq), nil
+}
+
+// recordAndStamp assigns the next sequence number for the channel, stamps
+// msg with it, and appends it to the channel's replay history.
+func (list *SubscriberList) recordAndStamp(msg ClientMessage) ClientMessage {
+	list.historyLock.Lock()
+	list.seq++
+	msg.Sequence = list.seq
+	list.history = append(list.history, cachedMessage{list.seq, msg})
+	if len(list.history) > ChannelHistorySize {
+		list.history = list.history[len(list.history)-ChannelHistorySize:]
+	}
+	list.historyLock.Unlock()
+	return msg
 }
 
 func SubscribeDefaults(client *ClientInfo) {
@@ -30,18 +128,53 @@ func SubscribeDefaults(client *ClientInfo) {
 
 func SubscribeGlobal(client *ClientInfo) {
 	GlobalSubscriptionInfo.Lock()
-	AddToSliceC(&GlobalSubscriptionInfo.Members, client.MessageChannel)
+	GlobalSubscriptionInfo.Members = append(GlobalSubscriptionInfo.Members, &subscriber{client})
 	GlobalSubscriptionInfo.Unlock()
 }
 
+// trySend performs a non-blocking enqueue onto the subscriber's current
+// MessageChannel. If the channel's buffer is full, the subscriber is
+// flagged as overflowed (once) instead of blocking, and the caller should
+// treat it as skipped.
+//
+// MessageChannel/QueueOverflow are read under client.Mutex because a resume
+// (see TryResumeSession) can repoint them at a new connection concurrently
+// with a publisher fanning out to this subscriber.
+func trySend(s *subscriber, msg OutgoingMessage) bool {
+	s.Client.Mutex.Lock()
+	msgChan := s.Client.MessageChannel
+	overflow := s.Client.QueueOverflow
+	s.Client.Mutex.Unlock()
+
+	select {
+	case msgChan <- msg:
+		return true
+	default:
+		select {
+		case overflow <- struct{}{}:
+		default:
+		}
+		return false
+	}
+}
+
 func PublishToChannel(channel string, msg ClientMessage) (count int) {
 	ChatSubscriptionLock.RLock()
 	list := ChatSubscriptionInfo[channel]
 	if list != nil {
+		msg = list.recordAndStamp(msg)
+		prepared, err := PrepareClientMessage(msg)
+		if err != nil {
+			log.Println("error preparing message for", channel, ":", err)
+			ChatSubscriptionLock.RUnlock()
+			return
+		}
+		out := OutgoingMessage{Msg: msg, Prepared: prepared}
 		list.RLock()
-		for _, msgChan := range list.Members {
-			msgChan <- msg
-			count++
+		for _, s := range list.Members {
+			if trySend(s, out) {
+				count++
+			}
 		}
 		list.RUnlock()
 	}
@@ -50,16 +183,20 @@ func PublishToChannel(channel string, msg ClientMessage) (count int) {
 }
 
 func PublishToMultiple(channels []string, msg ClientMessage) (count int) {
-	found := make(map[chan<- ClientMessage]struct{})
+	found := make(map[*ClientInfo]*subscriber)
 
 	ChatSubscriptionLock.RLock()
 
 	for _, channel := range channels {
 		list := ChatSubscriptionInfo[channel]
 		if list != nil {
+			// Stamp and record into this channel's own history too, same as
+			// PublishToChannel, so a later resubscribe with last_seq doesn't
+			// silently miss anything sent via this path.
+			msg = list.recordAndStamp(msg)
 			list.RLock()
-			for _, msgChan := range list.Members {
-				found[msgChan] = struct{}{}
+			for _, s := range list.Members {
+				found[s.Client] = s
 			}
 			list.RUnlock()
 		}
@@ -67,32 +204,67 @@ func PublishToMultiple(channels []string, msg ClientMessage) (count int) {
 
 	ChatSubscriptionLock.RUnlock()
 
-	for msgChan, _ := range found {
-		msgChan <- msg
-		count++
+	prepared, err := PrepareClientMessage(msg)
+	if err != nil {
+		log.Println("error preparing message for", channels, ":", err)
+		return
+	}
+	out := OutgoingMessage{Msg: msg, Prepared: prepared}
+
+	for _, s := range found {
+		if trySend(s, out) {
+			count++
+		}
 	}
 	return
 }
 
+// PublishToAll broadcasts msg to every globally-subscribed client. It's
+// marshalled (and, with permessage-deflate negotiated, compressed) exactly
+// once via PrepareClientMessage and the same PreparedMessage is handed to
+// every subscriber's MessageChannel.
 func PublishToAll(msg ClientMessage) (count int) {
+	prepared, err := PrepareClientMessage(msg)
+	if err != nil {
+		log.Println("error preparing broadcast message:", err)
+		return
+	}
+	out := OutgoingMessage{Msg: msg, Prepared: prepared}
+
 	GlobalSubscriptionInfo.RLock()
-	for _, msgChan := range GlobalSubscriptionInfo.Members {
-		msgChan <- msg
-		count++
+	for _, s := range GlobalSubscriptionInfo.Members {
+		if trySend(s, out) {
+			count++
+		}
 	}
 	GlobalSubscriptionInfo.RUnlock()
 	return
 }
 
+// removeSubscriber drops the entry for client. Members is small per-channel,
+// so a linear scan beats keeping a side index.
+func removeSubscriber(list *SubscriberList, client *ClientInfo) {
+	for i, s := range list.Members {
+		if s.Client == client {
+			list.Members = append(list.Members[:i], list.Members[i+1:]...)
+			return
+		}
+	}
+}
+
 func UnsubscribeSingleChat(client *ClientInfo, channelName string) {
 	ChatSubscriptionLock.RLock()
 	list := ChatSubscriptionInfo[channelName]
 	if list != nil {
 		list.Lock()
-		RemoveFromSliceC(&list.Members, client.MessageChannel)
+		removeSubscriber(list, client)
 		list.Unlock()
 	}
 	ChatSubscriptionLock.RUnlock()
+
+	if list != nil {
+		go publishPresenceEvent(channelName, PresenceLeaveCommand, client)
+	}
 }
 
 // Unsubscribe the client from all channels, AND clear the CurrentChannels / WatchingChannels fields.
@@ -107,22 +279,37 @@ func UnsubscribeAll(client *ClientInfo) {
 	client.Mutex.Unlock()
 
 	GlobalSubscriptionInfo.Lock()
-	RemoveFromSliceC(&GlobalSubscriptionInfo.Members, client.MessageChannel)
+	removeSubscriber(&GlobalSubscriptionInfo, client)
 	GlobalSubscriptionInfo.Unlock()
 
 	ChatSubscriptionLock.RLock()
+
+	// Snapshot and clear CurrentChannels under client.Mutex, then release it
+	// before taking any SubscriberList lock below. trySend takes
+	// client.Mutex while a publisher holds list.RLock(); holding
+	// client.Mutex across a nested list.Lock() here too would be an AB-BA
+	// deadlock against that publisher.
 	client.Mutex.Lock()
-	for _, v := range client.CurrentChannels {
+	channels := client.CurrentChannels
+	client.CurrentChannels = nil
+	client.Mutex.Unlock()
+
+	for _, v := range channels {
 		list := ChatSubscriptionInfo[v]
 		if list != nil {
 			list.Lock()
-			RemoveFromSliceC(&list.Members, client.MessageChannel)
+			removeSubscriber(list, client)
 			list.Unlock()
 		}
 	}
-	client.CurrentChannels = nil
-	client.Mutex.Unlock()
 	ChatSubscriptionLock.RUnlock()
+
+	// Most clients leave a channel by disconnecting rather than explicitly
+	// unsubscribing one at a time, so this is the path presence_leave needs
+	// to fire from for the roster to stay accurate in practice.
+	for _, v := range channels {
+		go publishPresenceEvent(v, PresenceLeaveCommand, client)
+	}
 }
 
 func unsubscribeAllClients() {
@@ -137,6 +324,7 @@ func unsubscribeAllClients() {
 const ReapingDelay = 1 * time.Minute
 
 // Checks ChatSubscriptionInfo for entries with no subscribers every ReapingDelay.
+// Deleting a reaped SubscriberList also drops its replay history with it.
 // Started from SetupServer().
 func pubsubJanitor() {
 	for {
@@ -160,19 +348,20 @@ func pubsubJanitor() {
 	}
 }
 
-// Add a channel to the subscriptions while holding a read-lock to the map.
+// Add a client to the subscriptions while holding a read-lock to the map.
 // Locks:
 //   - ALREADY HOLDING a read-lock to the 'which' top-level map via the rlocker object
 //   - possible write lock to the 'which' top-level map via the wlocker object
 //   - write lock to SubscriptionInfo (if not creating new)
-func _subscribeWhileRlocked(channelName string, value chan<- ClientMessage) {
+func _subscribeWhileRlocked(channelName string, client *ClientInfo) *SubscriberList {
+	value := &subscriber{client}
 	list := ChatSubscriptionInfo[channelName]
 	if list == nil {
 		// Not found, so create it
 		ChatSubscriptionLock.RUnlock()
 		ChatSubscriptionLock.Lock()
 		list = &SubscriberList{}
-		list.Members = []chan<- ClientMessage{value} // Create it populated, to avoid reaper
+		list.Members = []*subscriber{value} // Create it populated, to avoid reaper
 		ChatSubscriptionInfo[channelName] = list
 		ChatSubscriptionLock.Unlock()
 
@@ -186,7 +375,70 @@ func _subscribeWhileRlocked(channelName string, value chan<- ClientMessage) {
 		ChatSubscriptionLock.RLock()
 	} else {
 		list.Lock()
-		AddToSliceC(&list.Members, value)
+		list.Members = append(list.Members, value)
 		list.Unlock()
 	}
+
+	go publishPresenceEvent(channelName, PresenceJoinCommand, client)
+	return list
+}
+
+// PresenceStats reports how many clients are currently subscribed to
+// channelName, split out by authentication state.
+func PresenceStats(channelName string) (total, authenticated, anonymous int) {
+	ChatSubscriptionLock.RLock()
+	list := ChatSubscriptionInfo[channelName]
+	ChatSubscriptionLock.RUnlock()
+	if list == nil {
+		return 0, 0, 0
+	}
+
+	list.RLock()
+	defer list.RUnlock()
+	for _, s := range list.Members {
+		total++
+		if s.Client != nil && s.Client.Username != "" {
+			authenticated++
+		} else {
+			anonymous++
+		}
+	}
+	return
+}
+
+// PresenceMembers lists the clients currently subscribed to channelName, for
+// display as a channel roster.
+func PresenceMembers(channelName string) []*ClientInfo {
+	ChatSubscriptionLock.RLock()
+	list := ChatSubscriptionInfo[channelName]
+	ChatSubscriptionLock.RUnlock()
+	if list == nil {
+		return nil
+	}
+
+	list.RLock()
+	defer list.RUnlock()
+	members := make([]*ClientInfo, 0, len(list.Members))
+	for _, s := range list.Members {
+		members = append(members, s.Client)
+	}
+	return members
+}
+
+// publishPresenceEvent pushes a presence_join/presence_leave notice to the
+// channel's current subscribers.
+func publishPresenceEvent(channelName string, command Command, client *ClientInfo) {
+	PublishToChannel(channelName, ClientMessage{
+		Command:   command,
+		Arguments: presenceIdentity(client),
+	})
+}
+
+// presenceIdentity is what a client is displayed as in a presence roster:
+// their username if authenticated, or "anonymous" otherwise.
+func presenceIdentity(client *ClientInfo) string {
+	if client != nil && client.Username != "" {
+		return client.Username
+	}
+	return "anonymous"
 }